@@ -7,212 +7,301 @@ import (
 	"io"
 	"reflect"
 	"strconv"
-	"strings"
-	"text/scanner"
+	"sync"
 )
 
+// defaultMaxDepth is the nesting depth Unmarshal and a freshly
+// constructed Decoder enforce; see Decoder.MaxDepth.
+const defaultMaxDepth = 10000
+
 func Unmarshal(data []byte, out interface{}) (err error) {
-	lex := &lexer{scan: scanner.Scanner{Mode: scanner.GoTokens}}
-	lex.scan.Init(bytes.NewReader(data))
-	lex.next()
+	ds := newTokenReader(bytes.NewReader(data), defaultMaxDepth)
+	defer ds.close()
 	defer func() {
 		if x := recover(); x != nil {
-			err = fmt.Errorf("error at %s: %v", lex.scan.Position, x)
+			if e, ok := x.(error); ok {
+				err = e
+				return
+			}
+			err = fmt.Errorf("error at %s: %v", ds.posString(), x)
 		}
 	}()
-	read(lex, reflect.ValueOf(out).Elem())
+	read(ds, reflect.ValueOf(out).Elem())
 	return nil
 }
 
 type Decoder struct {
-	lex *lexer
+	ds *tokenReader
+
+	// MaxDepth bounds how many nested lists Decode will descend into
+	// before giving up with a *MaxDepthError. Zero means unlimited;
+	// NewDecoder sets it to defaultMaxDepth.
+	MaxDepth int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{ds: newTokenReader(r, defaultMaxDepth), MaxDepth: defaultMaxDepth}
+}
+
+// Close releases the lexer goroutine (and the reader behind it) reading
+// d's stream. Callers that stop calling Decode or Token before the
+// stream is exhausted - Token in particular exists to let a caller bail
+// out early - must call Close so that goroutine isn't left blocked
+// forever handing tokens to nobody. Calling Close after the stream is
+// already exhausted is a harmless no-op.
+func (d *Decoder) Close() {
+	d.ds.close()
 }
 
 func (d *Decoder) Decode(v interface{}) (err error) {
-	d.lex.next()
+	d.ds.maxDepth = d.MaxDepth
+	d.ds.depth = 0
 	defer func() {
 		if x := recover(); x != nil {
-			err = fmt.Errorf("error at %s: %v", d.lex.scan.Position, x)
+			if e, ok := x.(error); ok {
+				err = e
+				return
+			}
+			err = fmt.Errorf("error at %s: %v", d.ds.posString(), x)
 		}
 	}()
-	read(d.lex, reflect.ValueOf(v).Elem())
+	read(d.ds, reflect.ValueOf(v).Elem())
 	return nil
-
 }
 
-type Token interface{}
-type Symbol struct{ Value string }
-type String struct{ Value string }
-type Int struct{ Value int }
-type StartList struct{}
-type EndList struct{}
-
+// Token returns the next Token in the stream, the same Tokens that lex
+// emits on the channel returned by NewTokenStream.
 func (d *Decoder) Token() (Token, error) {
-	d.lex.next()
-	switch d.lex.token {
-	case scanner.Ident:
-		return Symbol{d.lex.text()}, nil
-	case scanner.String:
-		s, _ := strconv.Unquote(d.lex.text())
-		return String{s}, nil
-	case scanner.Int:
-		i, _ := strconv.Atoi(d.lex.text())
-		return Int{i}, nil
-	case '(':
-		return StartList{}, nil
-	case ')':
-		return EndList{}, nil
-	case scanner.EOF:
+	t := d.ds.toks.token()
+	d.ds.toks.advance()
+	switch t := t.(type) {
+	case endOfInput:
 		return nil, errors.New("EOF")
+	case Error:
+		return nil, fmt.Errorf("error at %s: %s", t.Pos, t.Msg)
+	default:
+		return t, nil
 	}
-	panic(fmt.Sprintf("unexpected token %q", d.lex.text()))
 }
 
-func NewDecoder(r io.Reader) *Decoder {
-	lex := &lexer{
-		scan: scanner.Scanner{Mode: scanner.GoTokens},
-	}
-	lex.scan.Init(r)
-	return &Decoder{lex: lex}
+// tokenReader adapts the raw Token channel into the small stateful API
+// that read and readList need: one token of lookahead, consume-with-want
+// semantics, and the depth bookkeeping behind MaxDepth.
+type tokenReader struct {
+	toks      *peekable
+	depth     int
+	maxDepth  int
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTokenReader(r io.Reader, maxDepth int) *tokenReader {
+	done := make(chan struct{})
+	return &tokenReader{toks: newPeekable(lex(r, done)), maxDepth: maxDepth, done: done}
 }
 
-type lexer struct {
-	scan  scanner.Scanner
-	token rune
+// close releases the lexer goroutine behind ds, even if its stream
+// wasn't read to completion - e.g. because read/readList panicked
+// partway through, or because a Decoder's caller stopped early.
+func (ds *tokenReader) close() {
+	ds.closeOnce.Do(func() { close(ds.done) })
 }
 
-func (lex *lexer) next()        { lex.token = lex.scan.Scan() }
-func (lex *lexer) text() string { return lex.scan.TokenText() }
+func (ds *tokenReader) posString() string { return ds.toks.pos.String() }
+
+func (ds *tokenReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("error at %s: %s", ds.posString(), fmt.Sprintf(format, args...))
+}
+
+func (ds *tokenReader) consumeStartList() {
+	if _, ok := ds.toks.token().(StartList); !ok {
+		panic(ds.errorf("got %v, want '('", ds.toks.token()))
+	}
+	ds.toks.advance()
+}
+
+func (ds *tokenReader) consumeEndList() {
+	if _, ok := ds.toks.token().(EndList); !ok {
+		panic(ds.errorf("got %v, want ')'", ds.toks.token()))
+	}
+	ds.toks.advance()
+}
 
-func (lex *lexer) consume(want rune) {
-	if lex.token != want {
-		panic(fmt.Sprintf("got %q, want %q", lex.text(), want))
+// enter and leave bracket every StartList the reflect-driven reader
+// descends into, so adversarial input like "((((..." fails with a
+// *MaxDepthError instead of overflowing the goroutine stack.
+func (ds *tokenReader) enter() {
+	ds.depth++
+	if ds.maxDepth > 0 && ds.depth > ds.maxDepth {
+		panic(&MaxDepthError{Depth: ds.maxDepth, Position: ds.posString()})
 	}
-	lex.next()
 }
 
-func read(lex *lexer, v reflect.Value) {
-	switch lex.token {
-	case scanner.Ident:
-		if lex.text() == "nil" {
+func (ds *tokenReader) leave() { ds.depth-- }
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+func read(ds *tokenReader, v reflect.Value) {
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		raw := readRaw(ds)
+		if err := v.Addr().Interface().(Unmarshaler).UnmarshalSExpr(raw); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	switch t := ds.toks.token().(type) {
+	case Symbol:
+		ds.toks.advance()
+		switch t.Value {
+		case "nil":
 			v.Set(reflect.Zero(v.Type()))
-			lex.next()
-			return
-		} else if lex.text() == "t" {
+		case "t":
 			v.SetBool(true)
-			lex.next()
-			return
+		default:
+			panic(ds.errorf("unexpected symbol %q", t.Value))
 		}
-	case scanner.String:
-		s, _ := strconv.Unquote(lex.text())
-		v.SetString(s)
-		lex.next()
-		return
-	case scanner.Int:
-		i, _ := strconv.Atoi(lex.text())
-		v.SetInt(int64(i))
-		lex.next()
-		return
-	case scanner.Float:
-		f, _ := strconv.ParseFloat(lex.text(), 64)
-		v.SetFloat(f)
-		lex.next()
-		return
-	case '(':
-		lex.next()
-		readList(lex, v)
-		lex.next()
-		return
+	case String:
+		ds.toks.advance()
+		v.SetString(t.Value)
+	case Int:
+		ds.toks.advance()
+		v.SetInt(int64(t.Value))
+	case Float:
+		ds.toks.advance()
+		v.SetFloat(t.Value)
+	case StartList:
+		ds.enter()
+		defer ds.leave()
+		ds.toks.advance()
+		readList(ds, v)
+		ds.consumeEndList()
+	case Error:
+		panic(ds.errorf("%s", t.Msg))
+	default:
+		panic(ds.errorf("unexpected token %v", t))
 	}
-	panic(fmt.Sprintf("unexpected token %q", lex.text()))
 }
 
-func readList(lex *lexer, v reflect.Value) {
+func readList(ds *tokenReader, v reflect.Value) {
 	switch v.Kind() {
 	case reflect.Array:
-		for i := 0; !endList(lex); i++ {
-			read(lex, v.Index(i))
+		for i := 0; !endList(ds); i++ {
+			read(ds, v.Index(i))
 		}
 
 	case reflect.Slice:
-		for !endList(lex) {
+		for !endList(ds) {
 			item := reflect.New(v.Type().Elem()).Elem()
-			read(lex, item)
+			read(ds, item)
 			v.Set(reflect.Append(v, item))
 		}
 
 	case reflect.Struct:
-		for !endList(lex) {
-			lex.consume('(')
-			if lex.token != scanner.Ident {
-				panic(fmt.Sprintf("got token %q, want field name", lex.text()))
+		for !endList(ds) {
+			ds.consumeStartList()
+			sym, ok := ds.toks.token().(Symbol)
+			if !ok {
+				panic(ds.errorf("got token %v, want field name", ds.toks.token()))
 			}
-			name := lex.text()
-			lex.next()
-			read(lex, v.FieldByName(name))
-			lex.consume(')')
+			ds.toks.advance()
+			field, err := fieldByName(v, sym.Value, ds.posString())
+			if err != nil {
+				panic(err)
+			}
+			read(ds, field)
+			ds.consumeEndList()
 		}
 
 	case reflect.Map:
 		v.Set(reflect.MakeMap(v.Type()))
-		for !endList(lex) {
-			lex.consume('(')
+		for !endList(ds) {
+			ds.consumeStartList()
 			key := reflect.New(v.Type().Key()).Elem()
-			read(lex, key)
+			read(ds, key)
 			value := reflect.New(v.Type().Elem()).Elem()
-			read(lex, value)
+			read(ds, value)
 			v.SetMapIndex(key, value)
-			lex.consume(')')
+			ds.consumeEndList()
 		}
 
 	case reflect.Interface:
-		typStr, _ := strconv.Unquote(lex.text())
-		typ := asType(typStr)
-		lex.next()
+		str, ok := ds.toks.token().(String)
+		if !ok {
+			panic(ds.errorf("got token %v, want a type tag", ds.toks.token()))
+		}
+		ds.toks.advance()
+		typ, ok := typeForTag(str.Value)
+		if !ok {
+			panic(ds.errorf("unknown type tag %q; see RegisterType", str.Value))
+		}
 		value := reflect.New(typ).Elem()
-		read(lex, value)
+		read(ds, value)
 		v.Set(value)
 
 	default:
-		panic(fmt.Sprintf("cannot decode list into %v", v.Type()))
+		panic(ds.errorf("cannot decode list into %v", v.Type()))
 	}
 }
 
-var atomTypes = map[string]reflect.Type{
-	"int":    reflect.TypeOf(int(0)),
-	"uint":   reflect.TypeOf(uint(0)),
-	"float":  reflect.TypeOf(float64(0)),
-	"bool":   reflect.TypeOf(false),
-	"string": reflect.TypeOf(""),
+// readRaw consumes one full value (an atom, or a StartList-delimited
+// list) from ds and reconstructs its S-expression text, for handing to
+// an Unmarshaler. ds's lookahead must be positioned at the start of the
+// value, as read leaves it.
+func readRaw(ds *tokenReader) []byte {
+	var buf bytes.Buffer
+	writeRaw(&buf, ds)
+	return buf.Bytes()
 }
 
-func asType(typ string) reflect.Type {
-	if t, ok := atomTypes[typ]; ok {
-		return t
-	}
-	if strings.HasPrefix(typ, "[]") {
-		return reflect.SliceOf(asType(typ[2:]))
-	}
-	if typ[0] == '[' {
-		i, j := 0, strings.IndexRune(typ, ']')
-		count, _ := strconv.Atoi(typ[i+1 : j])
-		elem := typ[j+1:]
-		return reflect.ArrayOf(count, asType(elem))
-	}
-	if strings.HasPrefix(typ, "map") {
-		i, j := strings.IndexRune(typ, '['), strings.IndexRune(typ, ']')
-		key := typ[i+1 : j]
-		elem := typ[j+1:]
-		return reflect.MapOf(asType(key), asType(elem))
+func writeRaw(buf *bytes.Buffer, ds *tokenReader) {
+	switch t := ds.toks.token().(type) {
+	case StartList:
+		ds.enter()
+		defer ds.leave()
+		ds.toks.advance()
+		buf.WriteByte('(')
+		first := true
+		for {
+			if _, ok := ds.toks.token().(EndList); ok {
+				break
+			}
+			if _, ok := ds.toks.token().(endOfInput); ok {
+				panic(ds.errorf("end of file"))
+			}
+			if !first {
+				buf.WriteByte(' ')
+			}
+			first = false
+			writeRaw(buf, ds)
+		}
+		ds.consumeEndList()
+		buf.WriteByte(')')
+	case Symbol:
+		ds.toks.advance()
+		buf.WriteString(t.Value)
+	case String:
+		ds.toks.advance()
+		buf.WriteString(strconv.Quote(t.Value))
+	case Int:
+		ds.toks.advance()
+		buf.WriteString(strconv.Itoa(t.Value))
+	case Float:
+		ds.toks.advance()
+		buf.WriteString(strconv.FormatFloat(t.Value, 'g', -1, 64))
+	case Error:
+		panic(ds.errorf("%s", t.Msg))
+	default:
+		panic(ds.errorf("unexpected token %v", t))
 	}
-	panic(fmt.Sprintf("unknown type %q", typ))
 }
 
-func endList(lex *lexer) bool {
-	switch lex.token {
-	case scanner.EOF:
-		panic("end of file")
-	case ')':
+func endList(ds *tokenReader) bool {
+	switch ds.toks.token().(type) {
+	case endOfInput:
+		panic(ds.errorf("end of file"))
+	case EndList:
 		return true
 	}
 	return false
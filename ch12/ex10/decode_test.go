@@ -0,0 +1,50 @@
+package sexpr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// nested is a minimal self-referential type that lets a test drive
+// arbitrarily deep list nesting without needing the interface type tags
+// that a []interface{} would require.
+type nested []nested
+
+func TestUnmarshalMaxDepth(t *testing.T) {
+	input := strings.Repeat("(", defaultMaxDepth+100)
+	var v nested
+	err := Unmarshal([]byte(input), &v)
+	if err == nil {
+		t.Fatal("Unmarshal of deeply nested input returned nil error, want one reporting the max depth was exceeded")
+	}
+	var depthErr *MaxDepthError
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("Unmarshal error = %v (%T), want a *MaxDepthError", err, err)
+	}
+}
+
+func TestDecodeDepthResetsAfterError(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(strings.Repeat("(", 3) + "X" + strings.Repeat(")", 3)))
+	var v nested
+	if err := dec.Decode(&v); err == nil {
+		t.Fatal("Decode of malformed input returned nil error")
+	}
+	if dec.ds.depth != 0 {
+		t.Fatalf("after a failed Decode, ds.depth = %d, want 0", dec.ds.depth)
+	}
+}
+
+func TestDecodeMaxDepthCustom(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(strings.Repeat("(", 10)))
+	dec.MaxDepth = 5
+	var v nested
+	err := dec.Decode(&v)
+	var depthErr *MaxDepthError
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("Decode error = %v (%T), want a *MaxDepthError", err, err)
+	}
+	if depthErr.Depth != 5 {
+		t.Errorf("MaxDepthError.Depth = %d, want 5", depthErr.Depth)
+	}
+}
@@ -0,0 +1,383 @@
+package sexpr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Marshal returns the S-expression encoding of v, using the same grammar
+// that Unmarshal and Decoder.Decode accept.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalIndent is like Marshal but indents each nested list onto its own
+// line, the way json.MarshalIndent formats objects and arrays.
+func MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetIndent(prefix, indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CycleError is returned by an Encoder when it finds a pointer, map, or
+// slice that is already being encoded further up the call stack.
+type CycleError struct {
+	Type reflect.Type
+	Path string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("sexpr: encoding cycle through %s at %s", e.Type, e.Path)
+}
+
+// MaxDepthError is returned when encoding or decoding gives up because it
+// exceeded the configured maximum nesting depth. Position is empty for
+// errors raised while encoding, where there is no source position to
+// report.
+type MaxDepthError struct {
+	Depth    int
+	Position string
+}
+
+func (e *MaxDepthError) Error() string {
+	if e.Position == "" {
+		return fmt.Sprintf("sexpr: exceeded max depth of %d", e.Depth)
+	}
+	return fmt.Sprintf("sexpr: exceeded max depth of %d at %s", e.Depth, e.Position)
+}
+
+// defaultEncodeMaxDepth is the depth limit a new Encoder is given; see
+// Encoder.MaxDepth.
+const defaultEncodeMaxDepth = 1024
+
+// Encoder writes the S-expression encoding of a value to an output
+// stream.
+type Encoder struct {
+	w      io.Writer
+	prefix string
+	indent string
+
+	// MaxDepth bounds how many nested lists Encode will descend into
+	// before giving up with a *MaxDepthError. Zero means use
+	// defaultEncodeMaxDepth.
+	MaxDepth int
+
+	depth int
+	seen  map[visit]bool
+}
+
+// visit identifies a pointer, map, or slice header already on the
+// encoding stack, so Encode can detect cycles instead of recursing
+// forever.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, MaxDepth: defaultEncodeMaxDepth}
+}
+
+// SetIndent configures the Encoder to indent each list onto its own line,
+// the way json.Encoder.SetIndent does. With both prefix and indent empty
+// (the default) everything is written on a single line.
+func (enc *Encoder) SetIndent(prefix, indent string) {
+	enc.prefix = prefix
+	enc.indent = indent
+}
+
+// Encode writes the S-expression encoding of v to the stream.
+func (enc *Encoder) Encode(v interface{}) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			if e, ok := x.(error); ok {
+				err = e
+				return
+			}
+			panic(x)
+		}
+	}()
+
+	enc.seen = make(map[visit]bool)
+	enc.depth = 0
+
+	var buf bytes.Buffer
+	enc.write(&buf, reflect.ValueOf(v), "$")
+
+	out := buf.Bytes()
+	if enc.prefix != "" || enc.indent != "" {
+		var indented bytes.Buffer
+		if err := Indent(&indented, out, enc.prefix, enc.indent); err != nil {
+			return err
+		}
+		out = indented.Bytes()
+	}
+	_, err = enc.w.Write(out)
+	return err
+}
+
+func (enc *Encoder) maxDepth() int {
+	if enc.MaxDepth == 0 {
+		return defaultEncodeMaxDepth
+	}
+	return enc.MaxDepth
+}
+
+// enter and leave bracket every composite writer (list, struct, map,
+// interface), so a deeply or infinitely nested value fails with a
+// *MaxDepthError instead of exhausting the stack.
+func (enc *Encoder) enter() {
+	enc.depth++
+	if max := enc.maxDepth(); max > 0 && enc.depth > max {
+		panic(&MaxDepthError{Depth: max})
+	}
+}
+
+func (enc *Encoder) leave() { enc.depth-- }
+
+// marshalerFor reports whether v (or, if v is addressable, a pointer to
+// v) implements Marshaler.
+func marshalerFor(v reflect.Value) (Marshaler, bool) {
+	if v.Type().Implements(marshalerType) {
+		return v.Interface().(Marshaler), true
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+// withVisit guards fn against cycles through v, which must be a Ptr,
+// Map, or Slice value.
+func (enc *Encoder) withVisit(v reflect.Value, path string, fn func()) {
+	key := visit{ptr: v.Pointer(), typ: v.Type()}
+	if enc.seen[key] {
+		panic(&CycleError{Type: v.Type(), Path: path})
+	}
+	enc.seen[key] = true
+	fn()
+	delete(enc.seen, key)
+}
+
+func (enc *Encoder) write(buf *bytes.Buffer, v reflect.Value, path string) {
+	if v.IsValid() {
+		if m, ok := marshalerFor(v); ok {
+			b, err := m.MarshalSExpr()
+			if err != nil {
+				panic(err)
+			}
+			buf.Write(b)
+			return
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		buf.WriteString("nil")
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("t")
+		} else {
+			buf.WriteString("nil")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+
+	case reflect.Float32, reflect.Float64:
+		buf.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+
+	case reflect.String:
+		buf.WriteString(strconv.Quote(v.String()))
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return
+		}
+		enc.withVisit(v, path, func() {
+			enc.write(buf, v.Elem(), path)
+		})
+
+	case reflect.Array:
+		enc.enter()
+		defer enc.leave()
+		buf.WriteByte('(')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			enc.write(buf, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+		buf.WriteByte(')')
+
+	case reflect.Slice:
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return
+		}
+		enc.withVisit(v, path, func() {
+			enc.enter()
+			defer enc.leave()
+			buf.WriteByte('(')
+			for i := 0; i < v.Len(); i++ {
+				if i > 0 {
+					buf.WriteByte(' ')
+				}
+				enc.write(buf, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			}
+			buf.WriteByte(')')
+		})
+
+	case reflect.Struct:
+		enc.enter()
+		defer enc.leave()
+		buf.WriteByte('(')
+		enc.writeStructFields(buf, v, path)
+		buf.WriteByte(')')
+
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return
+		}
+		enc.withVisit(v, path, func() {
+			enc.enter()
+			defer enc.leave()
+			buf.WriteByte('(')
+			enc.writeMapEntries(buf, v, path)
+			buf.WriteByte(')')
+		})
+
+	case reflect.Interface:
+		enc.writeInterface(buf, v, path)
+
+	default:
+		panic(fmt.Sprintf("sexpr: cannot encode %s", v.Type()))
+	}
+}
+
+func (enc *Encoder) writeStructFields(buf *bytes.Buffer, v reflect.Value, path string) {
+	first := true
+	for _, f := range cachedFields(v.Type()) {
+		fv := v.Field(f.index)
+		if f.omitempty && isEmptyValue(fv) {
+			continue
+		}
+		if !first {
+			buf.WriteByte(' ')
+		}
+		first = false
+		buf.WriteByte('(')
+		buf.WriteString(f.name)
+		buf.WriteByte(' ')
+		enc.write(buf, fv, path+"."+f.name)
+		buf.WriteByte(')')
+	}
+}
+
+func (enc *Encoder) writeMapEntries(buf *bytes.Buffer, v reflect.Value, path string) {
+	keys := v.MapKeys()
+	// Map iteration order is random; sort so that Marshal is
+	// deterministic and diffable.
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+	})
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteByte('(')
+		enc.write(buf, key, path)
+		buf.WriteByte(' ')
+		enc.write(buf, v.MapIndex(key), path)
+		buf.WriteByte(')')
+	}
+}
+
+// writeInterface encodes the concrete value held in an interface{} as
+// ("type" value), the form readList's reflect.Interface case expects.
+func (enc *Encoder) writeInterface(buf *bytes.Buffer, v reflect.Value, path string) {
+	elem := v.Elem()
+	if !elem.IsValid() {
+		buf.WriteString("nil")
+		return
+	}
+	tag, ok := tagForType(elem.Type())
+	if !ok {
+		panic(fmt.Sprintf("sexpr: type %s is not registered; see RegisterType", elem.Type()))
+	}
+
+	enc.enter()
+	defer enc.leave()
+	buf.WriteByte('(')
+	buf.WriteString(strconv.Quote(tag))
+	buf.WriteByte(' ')
+	enc.write(buf, elem, path)
+	buf.WriteByte(')')
+}
+
+// Indent appends to dst an indented form of the S-expression-encoded
+// source in src, writing each list element on its own line the way
+// json.Indent reformats a compact encoding.
+func Indent(dst *bytes.Buffer, src []byte, prefix, indent string) error {
+	depth := 0
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '"':
+			dst.WriteByte(c)
+			for i++; i < len(src); i++ {
+				dst.WriteByte(src[i])
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					dst.WriteByte(src[i])
+					continue
+				}
+				if src[i] == '"' {
+					break
+				}
+			}
+		case c == '(':
+			depth++
+			dst.WriteByte(c)
+			writeIndentNewline(dst, prefix, indent, depth)
+			if i+1 < len(src) && src[i+1] == ' ' {
+				i++
+			}
+		case c == ')':
+			depth--
+			dst.WriteByte(c)
+		case c == ' ':
+			writeIndentNewline(dst, prefix, indent, depth)
+		default:
+			dst.WriteByte(c)
+		}
+	}
+	return nil
+}
+
+func writeIndentNewline(dst *bytes.Buffer, prefix, indent string, depth int) {
+	dst.WriteByte('\n')
+	dst.WriteString(prefix)
+	for i := 0; i < depth; i++ {
+		dst.WriteString(indent)
+	}
+}
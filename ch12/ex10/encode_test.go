@@ -0,0 +1,85 @@
+package sexpr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+type movie struct {
+	Title  string
+	Year   int            `sexpr:"year,omitempty"`
+	Actors []string       `sexpr:"actors,omitempty"`
+	Ratios map[string]int `sexpr:"ratios,omitempty"`
+}
+
+func TestMarshalUnmarshalRoundTrip(t *testing.T) {
+	ts := []interface{}{
+		point{X: 1, Y: 2},
+		[]int{1, 2, 3},
+		movie{
+			Title:  "Casablanca",
+			Year:   1942,
+			Actors: []string{"Bogart", "Bergman"},
+			Ratios: map[string]int{"imdb": 88},
+		},
+		movie{Title: "Untitled"},
+	}
+	for _, want := range ts {
+		data, err := Marshal(want)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", want, err)
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(want))
+		if err := Unmarshal(data, got.Interface()); err != nil {
+			t.Errorf("Unmarshal(%s): %v", data, err)
+			continue
+		}
+		if g := got.Elem().Interface(); !reflect.DeepEqual(g, want) {
+			t.Errorf("round trip of %#v = %#v, want unchanged", want, g)
+		}
+	}
+}
+
+func TestMarshalOmitsEmptyFields(t *testing.T) {
+	data, err := Marshal(movie{Title: "Untitled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `((Title "Untitled"))`
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+}
+
+func TestMarshalIndent(t *testing.T) {
+	data, err := MarshalIndent(point{X: 1, Y: 2}, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(\n\t(\n\t\tX\n\t\t1)\n\t(\n\t\tY\n\t\t2))"
+	if string(data) != want {
+		t.Errorf("MarshalIndent = %q, want %q", data, want)
+	}
+}
+
+func TestEncodeCycle(t *testing.T) {
+	type link struct {
+		Next *link
+	}
+	a := &link{}
+	a.Next = a
+	_, err := Marshal(a)
+	var cycleErr *CycleError
+	if err == nil {
+		t.Fatal("Marshal of a cyclic value returned nil error, want a *CycleError")
+	}
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("Marshal error = %v (%T), want a *CycleError", err, err)
+	}
+}
@@ -0,0 +1,118 @@
+package sexpr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// UnknownFieldError reports an S-expression field name that does not
+// correspond to any field of the destination struct type.
+type UnknownFieldError struct {
+	Type  reflect.Type
+	Field string
+	Pos   string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("sexpr: unknown field %q for type %s at %s", e.Field, e.Type, e.Pos)
+}
+
+// fieldInfo records how one exported struct field is named on the wire
+// and whether Encode may omit it.
+type fieldInfo struct {
+	index     int
+	name      string
+	omitempty bool
+}
+
+// fieldCache memoizes the fieldInfo slice for a struct type, since
+// parsing struct tags on every decode/encode would otherwise dominate.
+var fieldCache sync.Map // reflect.Type -> []fieldInfo
+
+func cachedFields(t reflect.Type) []fieldInfo {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]fieldInfo)
+	}
+	fields := make([]fieldInfo, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		name, omitempty := parseFieldTag(sf)
+		fields = append(fields, fieldInfo{index: i, name: name, omitempty: omitempty})
+	}
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]fieldInfo)
+}
+
+// parseFieldTag reads the `sexpr:"name,omitempty"` tag off sf, falling
+// back to the Go field name when there is no tag or no name in it.
+func parseFieldTag(sf reflect.StructField) (name string, omitempty bool) {
+	tag := sf.Tag.Get("sexpr")
+	if tag == "" {
+		return sf.Name, false
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = sf.Name
+	}
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+	return name, omitempty
+}
+
+// fieldByName resolves an S-expression field name against v's type,
+// trying first an exact tag-name match, then an exact Go field-name
+// match, then a case-insensitive match against either - mirroring the
+// case-insensitive fallback encoding/json uses. pos is only used to
+// annotate the returned UnknownFieldError.
+func fieldByName(v reflect.Value, name, pos string) (reflect.Value, error) {
+	t := v.Type()
+	fields := cachedFields(t)
+
+	for _, f := range fields {
+		if f.name == name {
+			return v.Field(f.index), nil
+		}
+	}
+	for _, f := range fields {
+		if t.Field(f.index).Name == name {
+			return v.Field(f.index), nil
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) || strings.EqualFold(t.Field(f.index).Name, name) {
+			return v.Field(f.index), nil
+		}
+	}
+	return reflect.Value{}, &UnknownFieldError{Type: t, Field: name, Pos: pos}
+}
+
+// isEmptyValue reports whether v counts as empty for `omitempty`, by the
+// same rule encoding/json uses: zero-length arrays, maps, slices and
+// strings, false, zero numbers, and nil interfaces and pointers. A struct
+// is never empty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package sexpr
+
+import (
+	"reflect"
+	"testing"
+)
+
+type tagged struct {
+	FullName string `sexpr:"name"`
+	plain    string
+}
+
+func TestFieldByNameTagAndCaseFold(t *testing.T) {
+	ts := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "name"},     // exact tag match
+		{name: "NAME"},     // case-fold against the tag
+		{name: "FullName"}, // exact Go field name, tag notwithstanding
+		{name: "fullname"}, // case-fold against the Go field name
+		{name: "nope", wantErr: true},
+	}
+	for _, tc := range ts {
+		v := reflect.ValueOf(&tagged{}).Elem()
+		_, err := fieldByName(v, tc.name, "<test>")
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("fieldByName(%q) = nil error, want UnknownFieldError", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("fieldByName(%q) = %v, want a match", tc.name, err)
+		}
+	}
+}
+
+func TestUnmarshalUsesTagName(t *testing.T) {
+	var v tagged
+	if err := Unmarshal([]byte(`((name "Alice"))`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.FullName != "Alice" {
+		t.Errorf("FullName = %q, want %q", v.FullName, "Alice")
+	}
+}
+
+func TestMarshalOmitsUnexportedField(t *testing.T) {
+	v := tagged{FullName: "Bob", plain: "ignored"}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `((name "Bob"))`
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+}
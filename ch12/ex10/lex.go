@@ -0,0 +1,247 @@
+package sexpr
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"text/scanner"
+)
+
+// Token is any of Symbol, String, Int, Float, StartList, EndList, or
+// Error, as produced by lex.
+type Token interface{}
+
+// Every Token carries the scanner.Position at which it starts, the same
+// position text/scanner.Scanner itself reports, so error messages built
+// from a Token read line:column rather than a bare byte offset.
+type Symbol struct {
+	Value string
+	Pos   scanner.Position
+}
+type String struct {
+	Value string
+	Pos   scanner.Position
+}
+type Int struct {
+	Value int
+	Pos   scanner.Position
+}
+type Float struct {
+	Value float64
+	Pos   scanner.Position
+}
+type StartList struct{ Pos scanner.Position }
+type EndList struct{ Pos scanner.Position }
+
+// Error is a sentinel Token sent in place of a well-formed token when the
+// input can't be tokenized. Pos is the position at which the problem was
+// found.
+type Error struct {
+	Pos scanner.Position
+	Msg string
+}
+
+// tokenPos extracts the Pos field carried by any Token.
+func tokenPos(t Token) (scanner.Position, bool) {
+	switch t := t.(type) {
+	case Symbol:
+		return t.Pos, true
+	case String:
+		return t.Pos, true
+	case Int:
+		return t.Pos, true
+	case Float:
+		return t.Pos, true
+	case StartList:
+		return t.Pos, true
+	case EndList:
+		return t.Pos, true
+	case Error:
+		return t.Pos, true
+	}
+	return scanner.Position{}, false
+}
+
+// endOfInput is the unexported token a peekable synthesizes once its
+// channel has been closed, so callers never have to special-case a
+// closed channel on every read.
+type endOfInput struct{}
+
+// lexState is the state threaded through the stateFn transitions that
+// make up one lex goroutine. It wraps a text/scanner.Scanner for rune
+// classification - the underlying cursor is the same one decode.go used
+// to drive directly, but no code outside this file touches it anymore.
+type lexState struct {
+	scan   scanner.Scanner
+	tokens chan<- Token
+	done   <-chan struct{}
+}
+
+// stateFn is one step of the lexer: it consumes whatever it needs from s,
+// emits zero or more Tokens, and returns the state that should run next,
+// or nil to stop.
+type stateFn func(s *lexState) stateFn
+
+// emit hands t to whatever is reading s.tokens, or gives up as soon as
+// done fires. Without this, a consumer that stops draining the channel
+// before it's closed - the common case, since both Decoder and Eval are
+// meant to let a caller bail out early - would leave this goroutine
+// blocked on the send forever.
+func (s *lexState) emit(t Token) bool {
+	select {
+	case s.tokens <- t:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// lex tokenizes r in its own goroutine and returns a channel of Tokens,
+// closed once the input is exhausted or done fires, whichever comes
+// first.
+func lex(r io.Reader, done <-chan struct{}) <-chan Token {
+	ch := make(chan Token, 64)
+	s := &lexState{scan: scanner.Scanner{Mode: scanner.GoTokens}, tokens: ch, done: done}
+	s.scan.Init(r)
+	go func() {
+		defer close(ch)
+		for state := lexRoot; state != nil; {
+			state = state(s)
+		}
+	}()
+	return ch
+}
+
+// NewTokenStream tokenizes r the same way a Decoder does internally, for
+// callers who want to build their own reader over an S-expression stream
+// (e.g. into an AST) without going through the reflect-driven Decoder.
+// The caller must call the returned stop func once it's done reading
+// tokens - even if the stream wasn't drained to EOF - so the goroutine
+// doing the tokenizing isn't left blocked forever trying to hand a token
+// to nobody; calling it after the stream is already exhausted is a
+// harmless no-op.
+func NewTokenStream(r io.Reader) (tokens <-chan Token, stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() { once.Do(func() { close(done) }) }
+	return lex(r, done), stop
+}
+
+// lexRoot scans one token and dispatches to the stateFn that knows how
+// to turn it into a Token.
+func lexRoot(s *lexState) stateFn {
+	switch s.scan.Scan() {
+	case scanner.EOF:
+		return nil
+	case scanner.Ident:
+		return lexIdent
+	case scanner.String:
+		return lexString
+	case scanner.Int, scanner.Float:
+		return lexNumber
+	case '(':
+		return lexList
+	case ')':
+		return lexEndList
+	default:
+		return lexError
+	}
+}
+
+func lexIdent(s *lexState) stateFn {
+	if !s.emit(Symbol{Value: s.scan.TokenText(), Pos: s.scan.Position}) {
+		return nil
+	}
+	return lexRoot
+}
+
+func lexString(s *lexState) stateFn {
+	text := s.scan.TokenText()
+	str, err := strconv.Unquote(text)
+	if err != nil {
+		if !s.emit(Error{Pos: s.scan.Position, Msg: err.Error()}) {
+			return nil
+		}
+		return lexRoot
+	}
+	if !s.emit(String{Value: str, Pos: s.scan.Position}) {
+		return nil
+	}
+	return lexRoot
+}
+
+func lexNumber(s *lexState) stateFn {
+	text := s.scan.TokenText()
+	if i, err := strconv.Atoi(text); err == nil {
+		if !s.emit(Int{Value: i, Pos: s.scan.Position}) {
+			return nil
+		}
+		return lexRoot
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		if !s.emit(Error{Pos: s.scan.Position, Msg: err.Error()}) {
+			return nil
+		}
+		return lexRoot
+	}
+	if !s.emit(Float{Value: f, Pos: s.scan.Position}) {
+		return nil
+	}
+	return lexRoot
+}
+
+func lexList(s *lexState) stateFn {
+	if !s.emit(StartList{Pos: s.scan.Position}) {
+		return nil
+	}
+	return lexRoot
+}
+
+func lexEndList(s *lexState) stateFn {
+	if !s.emit(EndList{Pos: s.scan.Position}) {
+		return nil
+	}
+	return lexRoot
+}
+
+func lexError(s *lexState) stateFn {
+	if !s.emit(Error{Pos: s.scan.Position, Msg: fmt.Sprintf("unexpected token %q", s.scan.TokenText())}) {
+		return nil
+	}
+	return lexRoot
+}
+
+// peekable buffers a single Token of lookahead over a channel, so a
+// reader can decide what to do with a token before consuming it.
+type peekable struct {
+	ch   <-chan Token
+	peek *Token
+	pos  scanner.Position
+}
+
+func newPeekable(ch <-chan Token) *peekable {
+	return &peekable{ch: ch}
+}
+
+// token returns the current lookahead token, fetching one from the
+// channel if necessary, without consuming it. Once the channel is
+// closed, token always returns endOfInput{}.
+func (p *peekable) token() Token {
+	if p.peek == nil {
+		t, ok := <-p.ch
+		if !ok {
+			t = endOfInput{}
+		}
+		if pos, ok := tokenPos(t); ok {
+			p.pos = pos
+		}
+		p.peek = &t
+	}
+	return *p.peek
+}
+
+// advance discards the current lookahead token so the next call to token
+// fetches a fresh one.
+func (p *peekable) advance() { p.peek = nil }
@@ -0,0 +1,549 @@
+// Package path lets a caller register one or more path expressions
+// against an S-expression document and receive the matching sub-values
+// without decoding the whole document into memory first.
+package path
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	sexpr "gopl.io/ch12/ex10"
+)
+
+// Expr is a compiled path expression. Paths use a small grammar:
+//
+//	/             root
+//	.name         a struct field, matched exactly against the field name
+//	              as written in the document; struct tags and
+//	              case-insensitive matching are not applied, and map
+//	              string keys are reached only with {"key"}
+//	[n]           an array/slice index
+//	[start:end]   an array/slice range (either bound may be omitted)
+//	[*]           every array/slice element
+//	{"key"}       a map key
+//	{*}           every map entry
+//
+// e.g. `/.Cast[*].Name` or `/.Oscars{"Best Picture"}`.
+type Expr struct {
+	raw   string
+	steps []step
+}
+
+type stepKind int
+
+const (
+	stepField stepKind = iota
+	stepIndex
+	stepSlice
+	stepIndexWildcard
+	stepKey
+	stepKeyWildcard
+)
+
+type step struct {
+	kind       stepKind
+	name       string
+	start, end int // used by stepIndex (start) and stepSlice
+}
+
+// Compile parses expr into an Expr that Eval can test against a
+// document as it streams by.
+func Compile(expr string) (*Expr, error) {
+	if !strings.HasPrefix(expr, "/") {
+		return nil, fmt.Errorf("sexpr/path: path %q must start with /", expr)
+	}
+	rest := expr[1:]
+	var steps []step
+	for len(rest) > 0 {
+		var s step
+		var err error
+		s, rest, err = parseStep(expr, rest)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return &Expr{raw: expr, steps: steps}, nil
+}
+
+func parseStep(expr, rest string) (step, string, error) {
+	switch rest[0] {
+	case '.':
+		rest = rest[1:]
+		i := strings.IndexAny(rest, ".[{")
+		if i < 0 {
+			i = len(rest)
+		}
+		if i == 0 {
+			return step{}, "", fmt.Errorf("sexpr/path: empty field name in %q", expr)
+		}
+		return step{kind: stepField, name: rest[:i]}, rest[i:], nil
+
+	case '[':
+		j := strings.IndexByte(rest, ']')
+		if j < 0 {
+			return step{}, "", fmt.Errorf("sexpr/path: unterminated [ in %q", expr)
+		}
+		inner, rest := rest[1:j], rest[j+1:]
+		switch {
+		case inner == "*":
+			return step{kind: stepIndexWildcard}, rest, nil
+		case strings.Contains(inner, ":"):
+			parts := strings.SplitN(inner, ":", 2)
+			start, end := 0, -1
+			var err error
+			if parts[0] != "" {
+				if start, err = strconv.Atoi(parts[0]); err != nil {
+					return step{}, "", fmt.Errorf("sexpr/path: bad slice start in %q: %v", expr, err)
+				}
+			}
+			if parts[1] != "" {
+				if end, err = strconv.Atoi(parts[1]); err != nil {
+					return step{}, "", fmt.Errorf("sexpr/path: bad slice end in %q: %v", expr, err)
+				}
+			}
+			return step{kind: stepSlice, start: start, end: end}, rest, nil
+		default:
+			n, err := strconv.Atoi(inner)
+			if err != nil {
+				return step{}, "", fmt.Errorf("sexpr/path: bad index in %q: %v", expr, err)
+			}
+			return step{kind: stepIndex, start: n}, rest, nil
+		}
+
+	case '{':
+		j := strings.IndexByte(rest, '}')
+		if j < 0 {
+			return step{}, "", fmt.Errorf("sexpr/path: unterminated { in %q", expr)
+		}
+		inner, rest := rest[1:j], rest[j+1:]
+		if inner == "*" {
+			return step{kind: stepKeyWildcard}, rest, nil
+		}
+		key, err := strconv.Unquote(inner)
+		if err != nil {
+			return step{}, "", fmt.Errorf("sexpr/path: bad map key in %q: %v", expr, err)
+		}
+		return step{kind: stepKey, name: key}, rest, nil
+	}
+	return step{}, "", fmt.Errorf("sexpr/path: unexpected %q in %q", rest[0:1], expr)
+}
+
+// location is one frame of the path the evaluator is currently
+// descending through: a struct field name, an array/slice index, or a
+// map key, exactly one of which is set.
+type location struct {
+	field    string
+	hasField bool
+	index    int
+	hasIndex bool
+	key      string
+	hasKey   bool
+}
+
+func (e location) matches(s step) bool {
+	switch s.kind {
+	case stepField:
+		return e.hasField && e.field == s.name
+	case stepIndex:
+		return e.hasIndex && e.index == s.start
+	case stepSlice:
+		return e.hasIndex && e.index >= s.start && (s.end < 0 || e.index < s.end)
+	case stepIndexWildcard:
+		return e.hasIndex
+	case stepKey:
+		return e.hasKey && e.key == s.name
+	case stepKeyWildcard:
+		return e.hasKey
+	}
+	return false
+}
+
+// Match is one result delivered by Eval.Next.
+type Match struct {
+	Path  string
+	Value interface{}
+}
+
+// Eval walks a sexpr token stream, testing one or more compiled path
+// Exprs against it and reporting every sub-value that matches at least
+// one of them, without ever materializing a subtree it has ruled out.
+type Eval struct {
+	r        io.Reader
+	newValue func(path string) interface{}
+	exprs    []*Expr
+
+	// MaxDepth bounds how many nested lists walk and writeRaw will
+	// descend into before giving up with a *sexpr.MaxDepthError. Zero
+	// means use defaultEvalMaxDepth.
+	MaxDepth int
+
+	toks    *tokBuf
+	depth   int
+	matches chan Match
+	errc    chan error
+	started bool
+
+	// done and stop let Close unblock ev.run even if it's parked trying
+	// to send a Match to a caller that has stopped reading them - the
+	// common case, since Eval exists to pull a few values out of a large
+	// document rather than decode all of it. stop additionally releases
+	// the lexer goroutine feeding the token stream.
+	done      chan struct{}
+	stop      func()
+	closeOnce sync.Once
+}
+
+// defaultEvalMaxDepth is the depth limit a new Eval is given; see
+// Eval.MaxDepth.
+const defaultEvalMaxDepth = 1024
+
+// NewEval returns an Eval that reads S-expression tokens from r and
+// reports the sub-values matching any of exprs. newValue is called with
+// the textual form of a matching path to obtain a sample of the Go type
+// that match should be decoded into (mirroring how RegisterType
+// associates a type with an interface{} tag); if newValue is nil,
+// matches are delivered as the raw S-expression text of the sub-value.
+func NewEval(r io.Reader, newValue func(path string) interface{}, exprs ...*Expr) *Eval {
+	return &Eval{r: r, newValue: newValue, exprs: exprs, MaxDepth: defaultEvalMaxDepth, done: make(chan struct{})}
+}
+
+func (ev *Eval) maxDepth() int {
+	if ev.MaxDepth == 0 {
+		return defaultEvalMaxDepth
+	}
+	return ev.MaxDepth
+}
+
+// enter and leave bracket every list walk or writeRaw descends into, so
+// a pathologically deep match - or a deep subtree that must be skipped
+// via walk's recursive descent rather than skip's iterative one - fails
+// with a *sexpr.MaxDepthError instead of overflowing the goroutine
+// stack.
+func (ev *Eval) enter() {
+	ev.depth++
+	if max := ev.maxDepth(); max > 0 && ev.depth > max {
+		panic(&sexpr.MaxDepthError{Depth: max})
+	}
+}
+
+func (ev *Eval) leave() { ev.depth-- }
+
+// Next returns the next match in the stream, or io.EOF once the document
+// has been fully consumed.
+func (ev *Eval) Next() (path string, value interface{}, err error) {
+	if !ev.started {
+		ev.started = true
+		ev.matches = make(chan Match)
+		ev.errc = make(chan error, 1)
+		tokens, stop := sexpr.NewTokenStream(ev.r)
+		ev.toks = newTokBuf(tokens)
+		ev.stop = stop
+		go ev.run()
+	}
+	m, ok := <-ev.matches
+	if !ok {
+		if err := <-ev.errc; err != nil {
+			return "", nil, err
+		}
+		return "", nil, io.EOF
+	}
+	return m.Path, m.Value, nil
+}
+
+// Close releases the goroutines and the underlying reader behind an
+// Eval. Callers that stop calling Next before it returns io.EOF - the
+// common case, since Eval exists to pull a few matches out of a large
+// document rather than decode all of it - must call Close, or ev.run
+// (and the lexer goroutine feeding it) are left blocked forever trying
+// to hand a Match, or a token, to nobody. Calling Close after Next has
+// already returned io.EOF is a harmless no-op.
+func (ev *Eval) Close() {
+	ev.closeOnce.Do(func() { close(ev.done) })
+	if ev.stop != nil {
+		ev.stop()
+	}
+}
+
+func (ev *Eval) run() {
+	defer close(ev.matches)
+	defer func() {
+		if x := recover(); x != nil {
+			if e, ok := x.(error); ok {
+				ev.errc <- e
+				return
+			}
+			ev.errc <- fmt.Errorf("sexpr/path: %v", x)
+			return
+		}
+		ev.errc <- nil
+	}()
+	ev.walk(nil, "/")
+}
+
+// walk decides, for the value about to be read at loc, whether it is a
+// full match (emit it), a viable prefix of some Expr (descend into it),
+// or neither (skip it without buffering).
+func (ev *Eval) walk(loc []location, path string) {
+	full, viable := ev.test(loc)
+	if full {
+		ev.emit(loc, path)
+		return
+	}
+	if !viable {
+		ev.skip()
+		return
+	}
+	switch ev.toks.peek().(type) {
+	case sexpr.StartList:
+		ev.toks.advance()
+		ev.enter()
+		ev.walkList(loc, path)
+		ev.leave()
+		ev.toks.consumeEndList()
+	default:
+		ev.toks.advance()
+	}
+}
+
+func (ev *Eval) test(loc []location) (full, viable bool) {
+	for _, expr := range ev.exprs {
+		switch {
+		case len(loc) == len(expr.steps):
+			if matchesAll(loc, expr.steps) {
+				full = true
+			}
+		case len(loc) < len(expr.steps):
+			if matchesAll(loc, expr.steps[:len(loc)]) {
+				viable = true
+			}
+		}
+	}
+	return full, viable
+}
+
+func matchesAll(loc []location, steps []step) bool {
+	for i, l := range loc {
+		if !l.matches(steps[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkList descends into a list whose StartList has already been
+// consumed. It first classifies the list as a sequence of (name value)
+// pairs - a struct or a map, addressed with .field / {"key"} steps - or
+// a sequence of bare elements - an array or slice, addressed with [n]
+// steps - then walks each child accordingly.
+//
+// The S-expression grammar gives a slice of structs and a (name value)
+// pair list the same outer shape, so this is a heuristic: it assumes
+// real field names and map keys are written as bare symbols or strings,
+// never as their own nested list.
+func (ev *Eval) walkList(loc []location, path string) {
+	if _, ok := ev.toks.peek().(sexpr.EndList); ok {
+		return
+	}
+	if ev.classifyAsPairs() {
+		for i := 0; ; i++ {
+			if _, ok := ev.toks.peek().(sexpr.EndList); ok {
+				return
+			}
+			ev.toks.consumeStartList()
+			name, isKey := ev.readPairName()
+			var loc2 location
+			var childPath string
+			if isKey {
+				loc2 = location{key: name, hasKey: true}
+				childPath = fmt.Sprintf("%s{%s}", path, strconv.Quote(name))
+			} else {
+				loc2 = location{field: name, hasField: true}
+				childPath = path + "." + name
+			}
+			ev.walk(append(loc, loc2), childPath)
+			ev.toks.consumeEndList()
+		}
+	}
+	for i := 0; ; i++ {
+		if _, ok := ev.toks.peek().(sexpr.EndList); ok {
+			return
+		}
+		loc2 := location{index: i, hasIndex: true}
+		ev.walk(append(loc, loc2), fmt.Sprintf("%s[%d]", path, i))
+	}
+}
+
+// classifyAsPairs peeks two tokens deep - the list's first child, and
+// that child's first token - without consuming anything.
+func (ev *Eval) classifyAsPairs() bool {
+	if _, ok := ev.toks.peek().(sexpr.StartList); !ok {
+		return false
+	}
+	switch ev.toks.peekAt(1).(type) {
+	case sexpr.Symbol, sexpr.String:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ev *Eval) readPairName() (name string, isKey bool) {
+	switch t := ev.toks.advance().(type) {
+	case sexpr.Symbol:
+		return t.Value, false
+	case sexpr.String:
+		return t.Value, true
+	default:
+		panic(fmt.Errorf("sexpr/path: malformed input: want a field name or map key, got %v", t))
+	}
+}
+
+// errEvalClosed unwinds ev.run's walk once Close fires while emit is
+// blocked trying to deliver a Match; run's recover reports it like any
+// other error, which Next never observes since nothing calls it again
+// after Close.
+var errEvalClosed = errors.New("sexpr/path: Eval closed")
+
+// emit consumes exactly one value (an atom or a full list) and delivers
+// it as a Match.
+func (ev *Eval) emit(loc []location, path string) {
+	raw := ev.captureRaw()
+
+	var value interface{}
+	if ev.newValue == nil {
+		value = string(raw)
+	} else {
+		sample := ev.newValue(path)
+		target := reflect.New(reflect.TypeOf(sample)).Interface()
+		if err := sexpr.Unmarshal(raw, target); err != nil {
+			panic(err)
+		}
+		value = reflect.ValueOf(target).Elem().Interface()
+	}
+	select {
+	case ev.matches <- Match{Path: path, Value: value}:
+	case <-ev.done:
+		panic(errEvalClosed)
+	}
+}
+
+// captureRaw buffers the next value in the stream, reconstructing its
+// S-expression text from the tokens it consumes; the original spacing
+// and comments are not kept.
+func (ev *Eval) captureRaw() []byte {
+	var buf bytes.Buffer
+	ev.writeRaw(&buf)
+	return buf.Bytes()
+}
+
+func (ev *Eval) writeRaw(buf *bytes.Buffer) {
+	switch t := ev.toks.advance().(type) {
+	case sexpr.StartList:
+		ev.enter()
+		buf.WriteByte('(')
+		first := true
+		for {
+			if _, ok := ev.toks.peek().(sexpr.EndList); ok {
+				break
+			}
+			if !first {
+				buf.WriteByte(' ')
+			}
+			first = false
+			ev.writeRaw(buf)
+		}
+		ev.toks.consumeEndList()
+		buf.WriteByte(')')
+		ev.leave()
+	case sexpr.Symbol:
+		buf.WriteString(t.Value)
+	case sexpr.String:
+		buf.WriteString(strconv.Quote(t.Value))
+	case sexpr.Int:
+		buf.WriteString(strconv.Itoa(t.Value))
+	case sexpr.Float:
+		buf.WriteString(strconv.FormatFloat(t.Value, 'g', -1, 64))
+	default:
+		panic(fmt.Errorf("sexpr/path: malformed input: unexpected token %v", t))
+	}
+}
+
+// skip discards the next value without buffering it, by counting
+// StartList/EndList tokens until they balance back to zero.
+func (ev *Eval) skip() {
+	if _, ok := ev.toks.advance().(sexpr.StartList); !ok {
+		return
+	}
+	depth := 1
+	for depth > 0 {
+		switch ev.toks.advance().(type) {
+		case sexpr.StartList:
+			depth++
+		case sexpr.EndList:
+			depth--
+		}
+	}
+}
+
+// tokBuf is a small buffered reader over a sexpr.Token channel, giving
+// the evaluator the extra token of lookahead it needs to classify a
+// list before deciding how to descend into it.
+type tokBuf struct {
+	ch  <-chan sexpr.Token
+	buf []sexpr.Token
+}
+
+func newTokBuf(ch <-chan sexpr.Token) *tokBuf {
+	return &tokBuf{ch: ch}
+}
+
+func (b *tokBuf) fill(n int) {
+	for len(b.buf) <= n {
+		t, ok := <-b.ch
+		if !ok {
+			return
+		}
+		b.buf = append(b.buf, t)
+	}
+}
+
+// peekAt returns the token n positions ahead (0 is the next token), or
+// nil once the stream is exhausted.
+func (b *tokBuf) peekAt(n int) sexpr.Token {
+	b.fill(n)
+	if n >= len(b.buf) {
+		return nil
+	}
+	return b.buf[n]
+}
+
+func (b *tokBuf) peek() sexpr.Token { return b.peekAt(0) }
+
+func (b *tokBuf) advance() sexpr.Token {
+	b.fill(0)
+	if len(b.buf) == 0 {
+		panic(fmt.Errorf("sexpr/path: malformed input: unexpected end of file"))
+	}
+	t := b.buf[0]
+	b.buf = b.buf[1:]
+	return t
+}
+
+func (b *tokBuf) consumeStartList() {
+	if _, ok := b.advance().(sexpr.StartList); !ok {
+		panic(fmt.Errorf("sexpr/path: malformed input: want '('"))
+	}
+}
+
+func (b *tokBuf) consumeEndList() {
+	if _, ok := b.advance().(sexpr.EndList); !ok {
+		panic(fmt.Errorf("sexpr/path: malformed input: want ')'"))
+	}
+}
@@ -0,0 +1,117 @@
+package path
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	sexpr "gopl.io/ch12/ex10"
+)
+
+type actor struct {
+	Name string
+	Role string
+}
+
+type movie struct {
+	Title string
+	Cast  []actor
+}
+
+func TestEvalMatchesFieldAndWildcard(t *testing.T) {
+	data, err := sexpr.Marshal(movie{
+		Title: "Casablanca",
+		Cast: []actor{
+			{Name: "Bogart", Role: "Rick"},
+			{Name: "Bergman", Role: "Ilsa"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := string(data)
+
+	title, err := Compile("/.Title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := Compile("/.Cast[*].Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev := NewEval(strings.NewReader(doc), nil, title, names)
+	var got []string
+	for {
+		path, value, err := ev.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, path+"="+value.(string))
+	}
+
+	want := []string{`/.Title="Casablanca"`, `/.Cast[0].Name="Bogart"`, `/.Cast[1].Name="Bergman"`}
+	if len(got) != len(want) {
+		t.Fatalf("got %d matches %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i, g := range got {
+		if g != want[i] {
+			t.Errorf("match %d = %s, want %s", i, g, want[i])
+		}
+	}
+}
+
+func TestEvalDecodesIntoTypedValue(t *testing.T) {
+	doc := `((Name "Bogart"))`
+	expr, err := Compile("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEval(strings.NewReader(doc), func(string) interface{} { return actor{} }, expr)
+	_, value, err := ev.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := value.(actor)
+	if !ok || got.Name != "Bogart" {
+		t.Errorf("value = %#v, want actor{Name: \"Bogart\"}", value)
+	}
+}
+
+func TestEvalMaxDepth(t *testing.T) {
+	depth := defaultEvalMaxDepth + 100
+	doc := strings.Repeat("(", depth) + strings.Repeat(")", depth)
+
+	expr, err := Compile("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEval(strings.NewReader(doc), nil, expr)
+	_, _, err = ev.Next()
+	var depthErr *sexpr.MaxDepthError
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("Next() error = %v (%T), want a *sexpr.MaxDepthError", err, err)
+	}
+}
+
+func TestEvalMaxDepthCustom(t *testing.T) {
+	doc := strings.Repeat("(", 10) + strings.Repeat(")", 10)
+	expr, err := Compile("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEval(strings.NewReader(doc), nil, expr)
+	ev.MaxDepth = 5
+	_, _, err = ev.Next()
+	var depthErr *sexpr.MaxDepthError
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("Next() error = %v (%T), want a *sexpr.MaxDepthError", err, err)
+	}
+	if depthErr.Depth != 5 {
+		t.Errorf("MaxDepthError.Depth = %d, want 5", depthErr.Depth)
+	}
+}
@@ -0,0 +1,136 @@
+package sexpr
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Marshaler is implemented by types that want to encode themselves as an
+// S-expression atom or list instead of going through reflection.
+type Marshaler interface {
+	MarshalSExpr() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that want to decode their own
+// S-expression representation instead of going through reflection. The
+// argument is the text of that value, an atom or a fully-parenthesized
+// list, rebuilt from its tokens; the original spacing and comments are
+// not kept.
+type Unmarshaler interface {
+	UnmarshalSExpr([]byte) error
+}
+
+var (
+	registryMu sync.RWMutex
+	tagToType  = map[string]reflect.Type{}
+	typeToTag  = map[reflect.Type]string{}
+)
+
+func init() {
+	RegisterType("int", int(0))
+	RegisterType("uint", uint(0))
+	RegisterType("float", float64(0))
+	RegisterType("bool", false)
+	RegisterType("string", "")
+}
+
+// RegisterType associates tag with the type of sample, so that an
+// interface{} field decoded from ("tag" value) is constructed as that
+// type, and so that Marshal writes tag when it encodes a value of that
+// type through an interface{}. Composite tags ([]T, [N]T, map[K]V) are
+// built automatically from registered element types and never need to be
+// registered themselves.
+func RegisterType(tag string, sample interface{}) {
+	t := reflect.TypeOf(sample)
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	tagToType[tag] = t
+	typeToTag[t] = tag
+}
+
+// typeForTag resolves a type tag as read from an S-expression interface
+// value, checking the registry first and falling back to the composite
+// grammar ([]T, [N]T, map[K]V) that asType used to parse on its own.
+func typeForTag(tag string) (reflect.Type, bool) {
+	registryMu.RLock()
+	t, ok := tagToType[tag]
+	registryMu.RUnlock()
+	if ok {
+		return t, true
+	}
+
+	switch {
+	case strings.HasPrefix(tag, "[]"):
+		elem, ok := typeForTag(tag[2:])
+		if !ok {
+			return nil, false
+		}
+		return reflect.SliceOf(elem), true
+
+	case strings.HasPrefix(tag, "["):
+		j := strings.IndexRune(tag, ']')
+		if j < 0 {
+			return nil, false
+		}
+		count, err := strconv.Atoi(tag[1:j])
+		if err != nil {
+			return nil, false
+		}
+		elem, ok := typeForTag(tag[j+1:])
+		if !ok {
+			return nil, false
+		}
+		return reflect.ArrayOf(count, elem), true
+
+	case strings.HasPrefix(tag, "map["):
+		i, j := strings.IndexRune(tag, '['), strings.IndexRune(tag, ']')
+		if i < 0 || j < 0 {
+			return nil, false
+		}
+		key, ok1 := typeForTag(tag[i+1 : j])
+		elem, ok2 := typeForTag(tag[j+1:])
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return reflect.MapOf(key, elem), true
+	}
+
+	return nil, false
+}
+
+// tagForType is the inverse of typeForTag, used by the Encoder to write
+// the type tag for a value held in an interface{}.
+func tagForType(t reflect.Type) (string, bool) {
+	registryMu.RLock()
+	tag, ok := typeToTag[t]
+	registryMu.RUnlock()
+	if ok {
+		return tag, true
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		elem, ok := tagForType(t.Elem())
+		if !ok {
+			return "", false
+		}
+		return "[]" + elem, true
+	case reflect.Array:
+		elem, ok := tagForType(t.Elem())
+		if !ok {
+			return "", false
+		}
+		return "[" + strconv.Itoa(t.Len()) + "]" + elem, true
+	case reflect.Map:
+		key, ok1 := tagForType(t.Key())
+		elem, ok2 := tagForType(t.Elem())
+		if !ok1 || !ok2 {
+			return "", false
+		}
+		return "map[" + key + "]" + elem, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,77 @@
+package sexpr
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type box struct {
+	Contents interface{}
+}
+
+type rgb struct {
+	R, G, B int
+}
+
+func TestRegisterTypeRoundTrip(t *testing.T) {
+	RegisterType("rgb", rgb{})
+
+	want := box{Contents: rgb{R: 255, G: 0, B: 127}}
+	data, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got box
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip of %#v = %#v", want, got)
+	}
+}
+
+func TestUnmarshalUnknownTag(t *testing.T) {
+	var got box
+	err := Unmarshal([]byte(`((Contents ("notregistered" 1)))`), &got)
+	if err == nil {
+		t.Fatal("Unmarshal with an unregistered type tag returned nil error")
+	}
+}
+
+// celsius implements Marshaler and Unmarshaler, encoding itself as a bare
+// number of degrees rather than the struct form reflection would produce.
+type celsius float64
+
+func (c celsius) MarshalSExpr() ([]byte, error) {
+	return []byte(strconv.FormatFloat(float64(c), 'g', -1, 64)), nil
+}
+
+func (c *celsius) UnmarshalSExpr(data []byte) error {
+	f, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return err
+	}
+	*c = celsius(f)
+	return nil
+}
+
+func TestMarshalerUnmarshalerRoundTrip(t *testing.T) {
+	want := celsius(36.6)
+	data, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "36.6" {
+		t.Errorf("Marshal(celsius) = %s, want 36.6", data)
+	}
+
+	var got celsius
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Unmarshal(%s) = %v, want %v", data, got, want)
+	}
+}